@@ -0,0 +1,32 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+const (
+	// SessionFlow is emitted periodically for an active session with the
+	// bandwidth used since the previous sample.
+	SessionFlow = "session.flow"
+
+	// FlowIntervalStart and FlowIntervalEnd bound the period a SessionFlow
+	// sample covers.
+	FlowIntervalStart = "interval.start"
+	FlowIntervalEnd   = "interval.end"
+
+	// FlowPeakBps is the approximate peak bits-per-second observed during
+	// the sampled interval.
+	FlowPeakBps = "bps.peak"
+)
@@ -0,0 +1,47 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package events
+
+const (
+	// HandshakeSuccessful is emitted when an SSH key exchange and user auth
+	// complete, before a ServerContext exists.
+	HandshakeSuccessful = "handshake.success"
+
+	// HandshakeFailed is emitted when an SSH handshake is aborted before a
+	// ServerContext can be created.
+	HandshakeFailed = "handshake.failure"
+
+	// HandshakeClientVersion is the SSH identification string the client
+	// sent during the handshake.
+	HandshakeClientVersion = "client.version"
+
+	// HandshakeOfferedAlgorithms lists the key exchange, cipher and MAC
+	// algorithms the server offered during the handshake.
+	HandshakeOfferedAlgorithms = "algorithms.offered"
+
+	// HandshakeCertSerial is the serial number of the certificate being
+	// attempted, when known.
+	HandshakeCertSerial = "cert.serial"
+
+	// HandshakeFailureReason is the machine-readable reason a handshake was
+	// aborted, one of the HandshakeFailure* values in package srv.
+	HandshakeFailureReason = "reason.code"
+
+	// HandshakeError is the human-readable error that aborted the
+	// handshake.
+	HandshakeError = "error"
+)
@@ -0,0 +1,125 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// proxyAddrConn is implemented by connections that know the address of the
+// load balancer/proxy that terminated the raw TCP connection ahead of them,
+// as recovered from a PROXY protocol header.
+type proxyAddrConn interface {
+	ProxyAddr() net.Addr
+}
+
+// HandleConn is the common SSH connection entry point shared by the regular
+// node and the forwarding proxy. It recovers the real client address from
+// an optional PROXY protocol header (per proxyMode), performs the SSH
+// handshake, and emits handshake-phase audit events before a ServerContext
+// can be built — the same sequence both callers are expected to run between
+// accepting rawConn and calling NewServerContext.
+func HandleConn(srv Server, sshConfig *ssh.ServerConfig, proxyMode utils.ProxyProtocolMode, rawConn net.Conn) (*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request, *HandshakeContext, error) {
+	conn, err := utils.NewProxyProtocolConn(rawConn, proxyMode)
+	if err != nil {
+		return nil, nil, nil, nil, trace.Wrap(err)
+	}
+
+	hctx := NewHandshakeContext(conn)
+	hctx.SetOfferedAlgorithms(offeredAlgorithms(sshConfig))
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, wrapPublicKeyCallback(sshConfig, hctx))
+	if err != nil {
+		hctx.EmitFailure(srv, classifyHandshakeFailure(err), err)
+		return nil, nil, nil, hctx, trace.Wrap(err)
+	}
+	hctx.ClientVersion = string(sconn.ClientVersion())
+	hctx.EmitSuccess(srv)
+
+	if pc, ok := conn.(proxyAddrConn); ok {
+		if sconn.Permissions == nil {
+			sconn.Permissions = &ssh.Permissions{}
+		}
+		if sconn.Permissions.Extensions == nil {
+			sconn.Permissions.Extensions = make(map[string]string)
+		}
+		sconn.Permissions.Extensions[utils.ExtProxyAddr] = pc.ProxyAddr().String()
+	}
+
+	return sconn, chans, reqs, hctx, nil
+}
+
+// offeredAlgorithms returns the key exchange, cipher, and MAC algorithms
+// this server is configured to offer during the handshake.
+// golang.org/x/crypto/ssh does not expose the algorithms the client itself
+// offered, only what this side is willing to negotiate.
+func offeredAlgorithms(cfg *ssh.ServerConfig) []string {
+	var algos []string
+	algos = append(algos, cfg.KeyExchanges...)
+	algos = append(algos, cfg.Ciphers...)
+	algos = append(algos, cfg.MACs...)
+	return algos
+}
+
+// wrapPublicKeyCallback returns cfg unchanged if it has no PublicKeyCallback,
+// or otherwise a shallow copy of cfg whose PublicKeyCallback additionally
+// records the Teleport user and certificate serial being attempted on hctx.
+// A copy is used so cfg itself, which is typically shared across many
+// concurrent connections, is never mutated.
+func wrapPublicKeyCallback(cfg *ssh.ServerConfig, hctx *HandshakeContext) *ssh.ServerConfig {
+	if cfg.PublicKeyCallback == nil {
+		return cfg
+	}
+
+	wrapped := *cfg
+	orig := cfg.PublicKeyCallback
+	wrapped.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if cert, ok := key.(*ssh.Certificate); ok {
+			hctx.TeleportUser = conn.User()
+			hctx.CertSerial = strconv.FormatUint(cert.Serial, 10)
+		}
+		return orig(conn, key)
+	}
+	return &wrapped
+}
+
+// classifyHandshakeFailure turns an error from ssh.NewServerConn into one of
+// the machine-readable HandshakeFailureReason values, falling back to
+// HandshakeFailureAuthMethodNotAllowed for reasons golang.org/x/crypto/ssh
+// doesn't distinguish any further.
+func classifyHandshakeFailure(err error) HandshakeFailureReason {
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "no common algorithm"):
+		return HandshakeFailureNoMatchingKex
+	case strings.Contains(msg, "unable to authenticate"):
+		return HandshakeFailureAuthMethodNotAllowed
+	case strings.Contains(msg, "signature"):
+		return HandshakeFailureBadSignature
+	case strings.Contains(msg, "certificate"), strings.Contains(msg, "authority"):
+		return HandshakeFailureUnknownCA
+	default:
+		return HandshakeFailureAuthMethodNotAllowed
+	}
+}
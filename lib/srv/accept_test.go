@@ -0,0 +1,144 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/gravitational/teleport/lib/utils"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestProxyProtoConnSatisfiesProxyAddrConn(t *testing.T) {
+	var _ proxyAddrConn = &utils.ProxyProtoConn{}
+}
+
+func TestOfferedAlgorithmsCombinesConfiguredSets(t *testing.T) {
+	cfg := &ssh.ServerConfig{
+		Config: ssh.Config{
+			KeyExchanges: []string{"curve25519-sha256"},
+			Ciphers:      []string{"aes128-gcm@openssh.com"},
+			MACs:         []string{"hmac-sha2-256"},
+		},
+	}
+
+	got := offeredAlgorithms(cfg)
+	want := []string{"curve25519-sha256", "aes128-gcm@openssh.com", "hmac-sha2-256"}
+	if len(got) != len(want) {
+		t.Fatalf("offeredAlgorithms() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("offeredAlgorithms()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWrapPublicKeyCallbackNilIsUnchanged(t *testing.T) {
+	cfg := &ssh.ServerConfig{}
+	hctx := NewHandshakeContext(&acceptTestConn{})
+
+	if got := wrapPublicKeyCallback(cfg, hctx); got != cfg {
+		t.Fatalf("wrapPublicKeyCallback() = %p, want original cfg %p unchanged", got, cfg)
+	}
+}
+
+func TestWrapPublicKeyCallbackRecordsCertSerial(t *testing.T) {
+	cert := testCertificate(t, 42)
+
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return &ssh.Permissions{}, nil
+		},
+	}
+	hctx := NewHandshakeContext(&acceptTestConn{})
+
+	wrapped := wrapPublicKeyCallback(cfg, hctx)
+	if wrapped == cfg {
+		t.Fatal("wrapPublicKeyCallback() returned the original cfg, want a copy")
+	}
+
+	if _, err := wrapped.PublicKeyCallback(&fakeConnMetadata{user: "alice"}, cert); err != nil {
+		t.Fatalf("PublicKeyCallback: %v", err)
+	}
+
+	if hctx.TeleportUser != "alice" {
+		t.Fatalf("hctx.TeleportUser = %q, want %q", hctx.TeleportUser, "alice")
+	}
+	if want := strconv.FormatUint(cert.Serial, 10); hctx.CertSerial != want {
+		t.Fatalf("hctx.CertSerial = %q, want %q", hctx.CertSerial, want)
+	}
+
+	// The original cfg's callback must be left untouched.
+	if cfg.PublicKeyCallback == nil {
+		t.Fatal("original cfg.PublicKeyCallback was cleared")
+	}
+}
+
+// fakeConnMetadata is a minimal ssh.ConnMetadata stub for exercising a
+// PublicKeyCallback in isolation.
+type fakeConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (c *fakeConnMetadata) User() string { return c.user }
+
+// acceptTestConn is a minimal net.Conn, enough to construct a
+// HandshakeContext without a real socket.
+type acceptTestConn struct {
+	net.Conn
+}
+
+func (c *acceptTestConn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234} }
+func (c *acceptTestConn) LocalAddr() net.Addr  { return &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 3022} }
+
+// testCertificate returns a signed ssh.Certificate with the given serial,
+// suitable for exercising code that inspects certificate fields.
+func testCertificate(t *testing.T, serial uint64) *ssh.Certificate {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("ssh.NewSignerFromKey: %v", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:         sshPub,
+		Serial:      serial,
+		CertType:    ssh.UserCert,
+		ValidAfter:  0,
+		ValidBefore: ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+	return cert
+}
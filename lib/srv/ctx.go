@@ -66,6 +66,12 @@ type Server interface {
 	// EmitAuditEvent emits an Audit Event to the Auth Server.
 	EmitAuditEvent(string, events.EventFields)
 
+	// EmitHandshakeEvent emits a handshake-phase audit event (before a
+	// ServerContext exists), such as HandshakeSuccessful or
+	// HandshakeFailed. Both the regular node and the forwarding proxy
+	// implement this so handshake-phase logging is consistent between them.
+	EmitHandshakeEvent(eventType string, hctx *HandshakeContext, err error)
+
 	// GetAuditLog returns the Audit Log for this cluster.
 	GetAuditLog() events.IAuditLog
 
@@ -84,6 +90,18 @@ type Server interface {
 	// GetClock returns a clock setup for the server
 	GetClock() clockwork.Clock
 
+	// GetReconnectingPTYTimeout returns how long a detached PTY should be
+	// kept around waiting for a client to re-attach before it is reaped.
+	// A value <= 0 means the caller should fall back to
+	// DefaultReconnectingPTYTimeout.
+	GetReconnectingPTYTimeout() time.Duration
+
+	// GetFlowSampleInterval returns how often a ServerContext should
+	// snapshot its StatConn counters and emit a SessionFlow audit event.
+	// A value <= 0 means the caller should fall back to
+	// DefaultFlowSampleInterval.
+	GetFlowSampleInterval() time.Duration
+
 	// GetInfo returns a services.Server that represents this server.
 	GetInfo() services.Server
 }
@@ -191,6 +209,12 @@ type ServerContext struct {
 	// ClusterName is the name of the cluster current user is authenticated with.
 	ClusterName string
 
+	// ProxyAddr is the address of the load balancer or proxy that terminated
+	// the TCP connection carrying this SSH session, as recovered from a
+	// PROXY protocol header. Empty unless ProxyProtocol was enabled and a
+	// header was present.
+	ProxyAddr string
+
 	// ClusterConfig holds the cluster configuration at the time this context was
 	// created.
 	ClusterConfig services.ClusterConfig
@@ -219,11 +243,42 @@ type ServerContext struct {
 
 	// cancel is called whenever server context is closed
 	cancel context.CancelFunc
+
+	// reconnectID is the client-supplied reconnect token (see
+	// ReconnectingPTYEnvVar) identifying the detached PTY this context's
+	// Terminal should be registered under when the context closes, or
+	// re-attached from, if one is pending. Empty if reconnect was not
+	// requested.
+	reconnectID string
+
+	// reconnectSessionID is the ID of the session that originally requested
+	// reconnectID, recorded for the PTYReconnect audit event emitted on
+	// successful re-attach.
+	reconnectSessionID rsession.ID
+
+	// reconnectBuffer is the scrollback ring buffer teed off this context's
+	// Terminal output, if it implements ReconnectingTerminal. Carried over
+	// across detach/reattach cycles so scrollback history isn't lost.
+	reconnectBuffer *ptyRingBuffer
+
+	// reconnectTeeing is true once startReconnectTee has wired
+	// reconnectBuffer into the current Terminal.
+	reconnectTeeing bool
+
+	// flowSamples holds the bandwidth samples collected by startFlowSampler.
+	flowSamples []FlowSample
+
+	// flowSampleInterval overrides both DefaultFlowSampleInterval and
+	// Server.GetFlowSampleInterval when non-zero, used by tests to avoid
+	// waiting on the real interval.
+	flowSampleInterval time.Duration
 }
 
 // NewServerContext creates a new *ServerContext which is used to pass and
-// manage resources.
-func NewServerContext(srv Server, conn *ssh.ServerConn, identityContext IdentityContext) (*ServerContext, error) {
+// manage resources. If hctx is non-nil, it is promoted into the new
+// ServerContext (see HandshakeContext.Promote) so that identity recorded
+// during the handshake phase is not logged twice.
+func NewServerContext(srv Server, conn *ssh.ServerConn, identityContext IdentityContext, hctx *HandshakeContext) (*ServerContext, error) {
 	clusterConfig, err := srv.GetAccessPoint().GetClusterConfig()
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -239,6 +294,7 @@ func NewServerContext(srv Server, conn *ssh.ServerConn, identityContext Identity
 		ExecResultCh:      make(chan ExecResult, 10),
 		SubsystemResultCh: make(chan SubsystemResult, 10),
 		ClusterName:       conn.Permissions.Extensions[utils.CertTeleportClusterName],
+		ProxyAddr:         conn.Permissions.Extensions[utils.ExtProxyAddr],
 		ClusterConfig:     clusterConfig,
 		Identity:          identityContext,
 		clientIdleTimeout: identityContext.RoleSet.AdjustClientIdleTimeout(clusterConfig.GetClientIdleTimeout()),
@@ -273,6 +329,12 @@ func NewServerContext(srv Server, conn *ssh.ServerConn, identityContext Identity
 		go ctx.periodicCheckDisconnect()
 	}
 
+	if hctx != nil {
+		hctx.Promote(ctx)
+	}
+
+	ctx.startFlowSampler()
+
 	return ctx, nil
 }
 
@@ -319,6 +381,9 @@ func (c *ServerContext) CreateOrJoinSession(reg *SessionRegistry) error {
 		log.Debugf("Will join session %v for SSH connection %v.", c.session, c.Conn.RemoteAddr())
 	}
 
+	c.maybeRegisterReconnectingPTY(rsession.ID(ssid))
+	c.maybeReattachReconnectingPTY()
+
 	return nil
 }
 
@@ -350,6 +415,7 @@ func (c *ServerContext) periodicCheckDisconnect() {
 				events.SessionServerID: c.srv.ID(),
 				events.Reason:          fmt.Sprintf("client certificate expired at %v", c.clientLastActive),
 			}
+			c.MaybeSetProxyAddr(event)
 			c.srv.EmitAuditEvent(events.ClientDisconnectEvent, event)
 			c.Debugf("Disconnecting client: %v", event[events.Reason])
 			c.Conn.Close()
@@ -372,6 +438,7 @@ func (c *ServerContext) periodicCheckDisconnect() {
 					event[events.Reason] = fmt.Sprintf("client is idle for %v, exceeded idle timeout of %v",
 						now.Sub(clientLastActive), c.clientIdleTimeout)
 				}
+				c.MaybeSetProxyAddr(event)
 				c.Debugf("Disconnecting client: %v", event[events.Reason])
 				c.srv.EmitAuditEvent(events.ClientDisconnectEvent, event)
 				c.Conn.Close()
@@ -387,6 +454,17 @@ func (c *ServerContext) periodicCheckDisconnect() {
 	}
 }
 
+// MaybeSetProxyAddr adds the load balancer/proxy address behind which this
+// connection was received to fields, if PROXY protocol enrichment recovered
+// one for this context. Exported so that every audit event built for this
+// connection can be enriched the same way, including session.start, which
+// is emitted from the session/registry code path rather than from here.
+func (c *ServerContext) MaybeSetProxyAddr(fields events.EventFields) {
+	if c.ProxyAddr != "" {
+		fields[events.ProxyAddr] = c.ProxyAddr
+	}
+}
+
 // GetClientLastActive returns time when client was last active
 func (c *ServerContext) GetClientLastActive() time.Time {
 	c.RLock()
@@ -447,9 +525,10 @@ func (c *ServerContext) GetTerm() Terminal {
 // SetTerm set a Terminal.
 func (c *ServerContext) SetTerm(t Terminal) {
 	c.Lock()
-	defer c.Unlock()
-
 	c.term = t
+	c.Unlock()
+
+	c.startReconnectTee()
 }
 
 // SetEnv sets a environment variable within this context.
@@ -520,10 +599,18 @@ func (c *ServerContext) Close() error {
 		if c.session != nil {
 			eventFields[events.SessionEventID] = c.session.id
 		}
+		c.MaybeSetProxyAddr(eventFields)
 
 		auditLog.EmitAuditEvent(events.SessionDataEvent, eventFields)
 	}()
 
+	// If the client asked for a reconnecting PTY, hand the Terminal off to
+	// the reconnecting PTY registry instead of closing it below, and keep
+	// enforcing its idle/cert-expiry deadlines against the detached session.
+	if entry, detached := c.detachReconnectingPTY(); detached {
+		c.continueDisconnectMonitor(c.reconnectID, entry)
+	}
+
 	// Unblock any goroutines waiting until session is closed.
 	c.cancel()
 
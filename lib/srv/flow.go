@@ -0,0 +1,142 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+	rsession "github.com/gravitational/teleport/lib/session"
+)
+
+// DefaultFlowSampleInterval is how often a ServerContext snapshots its
+// StatConn counters and emits a SessionFlow audit event, unless overridden.
+const DefaultFlowSampleInterval = 30 * time.Second
+
+// FlowSample is a single bandwidth measurement over one sampling interval.
+type FlowSample struct {
+	// SessionID is the session this sample was taken for, if the context
+	// had joined one by the time the sample was taken.
+	SessionID rsession.ID
+
+	// IntervalStart and IntervalEnd bound the period this sample covers.
+	IntervalStart time.Time
+	IntervalEnd   time.Time
+
+	// TxBytes and RxBytes are the bytes sent/received during the interval.
+	TxBytes uint64
+	RxBytes uint64
+
+	// PeakBps is the average bits-per-second over the interval. It is an
+	// approximation of the peak rate: StatConn is only sampled once per
+	// tick, so bursts shorter than the sampling interval are smoothed out.
+	PeakBps float64
+}
+
+// FlowStats returns a snapshot of the bandwidth samples collected for this
+// context so far, for rendering live throughput (e.g. in the web UI or
+// `tctl sessions ls`).
+func (c *ServerContext) FlowStats() []FlowSample {
+	c.Lock()
+	defer c.Unlock()
+
+	out := make([]FlowSample, len(c.flowSamples))
+	copy(out, c.flowSamples)
+	return out
+}
+
+// startFlowSampler periodically diffs this context's StatConn counters and
+// emits a SessionFlow audit event for each interval. It runs for the
+// lifetime of the context's cancelContext, and is a no-op until StatConn is
+// assigned. Flow samples are produced even when session recording happens
+// at the proxy, unlike the SessionDataEvent emitted from Close.
+func (c *ServerContext) startFlowSampler() {
+	interval := c.flowSampleInterval
+	if interval == 0 {
+		interval = DefaultFlowSampleInterval
+		if t := c.srv.GetFlowSampleInterval(); t > 0 {
+			interval = t
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var lastTx, lastRx uint64
+		lastTick := c.srv.GetClock().Now().UTC()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				if c.StatConn == nil {
+					lastTick = now
+					continue
+				}
+
+				tx, rx := c.StatConn.Stat()
+				sid, _ := c.sessionID()
+				sample := newFlowSample(sid, lastTick, now, lastTx, lastRx, tx, rx)
+				lastTx, lastRx, lastTick = tx, rx, now
+
+				c.Lock()
+				c.flowSamples = append(c.flowSamples, sample)
+				c.Unlock()
+
+				c.srv.EmitAuditEvent(events.SessionFlow, events.EventFields{
+					events.SessionEventID:    sample.SessionID,
+					events.FlowIntervalStart: sample.IntervalStart,
+					events.FlowIntervalEnd:   sample.IntervalEnd,
+					events.DataTransmitted:   sample.TxBytes,
+					events.DataReceived:      sample.RxBytes,
+					events.FlowPeakBps:       sample.PeakBps,
+				})
+			case <-c.cancelContext.Done():
+				return
+			}
+		}
+	}()
+}
+
+// newFlowSample computes the FlowSample for an interval running from lastTick
+// to now, given the StatConn byte counters at the start (lastTx/lastRx) and
+// end (tx/rx) of the interval.
+func newFlowSample(sessionID rsession.ID, lastTick, now time.Time, lastTx, lastRx, tx, rx uint64) FlowSample {
+	sample := FlowSample{
+		SessionID:     sessionID,
+		IntervalStart: lastTick,
+		IntervalEnd:   now,
+		TxBytes:       tx - lastTx,
+		RxBytes:       rx - lastRx,
+	}
+	if elapsed := now.Sub(lastTick).Seconds(); elapsed > 0 {
+		sample.PeakBps = float64((sample.TxBytes+sample.RxBytes)*8) / elapsed
+	}
+	return sample
+}
+
+// sessionID returns the ID of the active session attached to this context,
+// if any.
+func (c *ServerContext) sessionID() (rsession.ID, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.session == nil {
+		return "", false
+	}
+	return c.session.id, true
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewFlowSampleDiffsCounters(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10 * time.Second)
+
+	sample := newFlowSample("test-session", start, end, 1000, 2000, 1500, 2500)
+
+	if sample.SessionID != "test-session" {
+		t.Fatalf("SessionID = %v, want test-session", sample.SessionID)
+	}
+	if sample.TxBytes != 500 {
+		t.Fatalf("TxBytes = %d, want 500 (tx - lastTx)", sample.TxBytes)
+	}
+	if sample.RxBytes != 500 {
+		t.Fatalf("RxBytes = %d, want 500 (rx - lastRx)", sample.RxBytes)
+	}
+	if !sample.IntervalStart.Equal(start) || !sample.IntervalEnd.Equal(end) {
+		t.Fatalf("interval = [%v, %v], want [%v, %v]", sample.IntervalStart, sample.IntervalEnd, start, end)
+	}
+
+	wantBps := float64(1000*8) / 10
+	if sample.PeakBps != wantBps {
+		t.Fatalf("PeakBps = %v, want %v", sample.PeakBps, wantBps)
+	}
+}
+
+func TestNewFlowSampleZeroElapsedDoesNotDivideByZero(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	sample := newFlowSample("", now, now, 0, 0, 100, 100)
+
+	if sample.PeakBps != 0 {
+		t.Fatalf("PeakBps = %v, want 0 for a zero-length interval", sample.PeakBps)
+	}
+}
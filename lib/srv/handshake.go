@@ -0,0 +1,178 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"net"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+)
+
+// HandshakeFailureReason is a machine-readable reason an SSH handshake was
+// aborted before a ServerContext could be created.
+type HandshakeFailureReason string
+
+const (
+	// HandshakeFailureNoMatchingKex means the client and server could not
+	// agree on a key exchange algorithm.
+	HandshakeFailureNoMatchingKex HandshakeFailureReason = "no_matching_kex"
+
+	// HandshakeFailureBadSignature means a signature presented during the
+	// handshake did not verify.
+	HandshakeFailureBadSignature HandshakeFailureReason = "bad_signature"
+
+	// HandshakeFailureUnknownCA means the certificate authority that signed
+	// the presented certificate is not trusted by this cluster.
+	HandshakeFailureUnknownCA HandshakeFailureReason = "unknown_ca"
+
+	// HandshakeFailureRateLimited means the connection was rejected before
+	// authentication could proceed because of connection rate limiting.
+	HandshakeFailureRateLimited HandshakeFailureReason = "rate_limited"
+
+	// HandshakeFailureAuthMethodNotAllowed means the client only offered
+	// authentication methods this cluster does not accept.
+	HandshakeFailureAuthMethodNotAllowed HandshakeFailureReason = "auth_method_not_allowed"
+)
+
+// HandshakeContext carries everything known about an SSH connection before
+// authentication completes and a full ServerContext can be built. It is
+// created as soon as a raw connection is accepted and is promoted (see
+// Promote) once NewServerContext succeeds, so that handshake and post-auth
+// logging never describe the same connection twice.
+type HandshakeContext struct {
+	// StartTime is when the handshake began.
+	StartTime time.Time
+
+	// LocalAddr and RemoteAddr are the addresses of the accepted connection.
+	// When a PROXY protocol header supplied a client address, RemoteAddr is
+	// that client address rather than the load balancer's.
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// ClientVersion is the SSH identification string the client sent
+	// (golang.org/x/crypto/ssh.ConnMetadata.ClientVersion).
+	ClientVersion string
+
+	// OfferedAlgorithms lists the key exchange, cipher and MAC algorithms
+	// this server offered during the handshake. The client's own offer is
+	// not recorded.
+	OfferedAlgorithms []string
+
+	// TeleportUser and CertSerial identify the identity being attempted,
+	// once known (unset for handshakes that fail before user auth).
+	TeleportUser string
+	CertSerial   string
+
+	// failureReason is set by EmitFailure so HandshakeEventFields can
+	// include it in the emitted event.
+	failureReason HandshakeFailureReason
+
+	// emitted is set once EmitSuccess or EmitFailure has fired a handshake
+	// event for this connection, and by Promote once a ServerContext has
+	// taken over logging for it. Once set, further EmitSuccess/EmitFailure
+	// calls are no-ops, which is what actually prevents the handshake and
+	// post-auth event trails from double-logging the same connection.
+	emitted bool
+}
+
+// NewHandshakeContext starts tracking a freshly accepted, not yet
+// authenticated, connection.
+func NewHandshakeContext(conn net.Conn) *HandshakeContext {
+	return &HandshakeContext{
+		StartTime:  time.Now(),
+		LocalAddr:  conn.LocalAddr(),
+		RemoteAddr: conn.RemoteAddr(),
+	}
+}
+
+// fields returns the common event fields shared by handshake success and
+// failure events.
+func (h *HandshakeContext) fields() events.EventFields {
+	fields := events.EventFields{
+		events.LocalAddr:  h.LocalAddr.String(),
+		events.RemoteAddr: h.RemoteAddr.String(),
+	}
+	if h.ClientVersion != "" {
+		fields[events.HandshakeClientVersion] = h.ClientVersion
+	}
+	if len(h.OfferedAlgorithms) > 0 {
+		fields[events.HandshakeOfferedAlgorithms] = h.OfferedAlgorithms
+	}
+	if h.TeleportUser != "" {
+		fields[events.EventUser] = h.TeleportUser
+	}
+	if h.CertSerial != "" {
+		fields[events.HandshakeCertSerial] = h.CertSerial
+	}
+	return fields
+}
+
+// EmitSuccess records a completed SSH key exchange and user auth via
+// srv.EmitHandshakeEvent. A no-op if this handshake has already emitted an
+// event or been promoted into a ServerContext.
+func (h *HandshakeContext) EmitSuccess(srv Server) {
+	if h.emitted {
+		return
+	}
+	h.emitted = true
+	srv.EmitHandshakeEvent(events.HandshakeSuccessful, h, nil)
+}
+
+// EmitFailure records an aborted handshake with a machine-readable reason
+// via srv.EmitHandshakeEvent. A no-op if this handshake has already emitted
+// an event or been promoted into a ServerContext.
+func (h *HandshakeContext) EmitFailure(srv Server, reason HandshakeFailureReason, err error) {
+	if h.emitted {
+		return
+	}
+	h.emitted = true
+	h.failureReason = reason
+	srv.EmitHandshakeEvent(events.HandshakeFailed, h, err)
+}
+
+// Promote hands this handshake over to ctx. It does not modify ctx: it
+// copies ctx's Teleport user onto h if h has none recorded yet, and marks
+// this handshake as emitted: ctx now owns auditing for the connection, so any
+// further EmitSuccess/EmitFailure call on h (e.g. from code that doesn't
+// realize auth already completed) is suppressed instead of double-logging.
+func (h *HandshakeContext) Promote(ctx *ServerContext) {
+	if h.TeleportUser == "" {
+		h.TeleportUser = ctx.Identity.TeleportUser
+	}
+	h.emitted = true
+}
+
+// HandshakeEventFields builds the full event field set for a handshake
+// audit event, for use by Server implementations inside EmitHandshakeEvent.
+func HandshakeEventFields(hctx *HandshakeContext, err error) events.EventFields {
+	fields := hctx.fields()
+	if hctx.failureReason != "" {
+		fields[events.HandshakeFailureReason] = string(hctx.failureReason)
+	}
+	if err != nil {
+		fields[events.HandshakeError] = err.Error()
+	}
+	return fields
+}
+
+// SetOfferedAlgorithms records the algorithm names offered during key
+// exchange. HandleConn passes the server's configured set (see
+// offeredAlgorithms); the client's own offer is not available.
+func (h *HandshakeContext) SetOfferedAlgorithms(algos []string) {
+	h.OfferedAlgorithms = append([]string(nil), algos...)
+}
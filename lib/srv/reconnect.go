@@ -0,0 +1,422 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+)
+
+const (
+	// ReconnectingPTYEnvVar is the name of the environment variable a client
+	// sets to request that its PTY survive a dropped connection. The value
+	// is an opaque, client-generated token used to re-attach on a subsequent
+	// SSH session.
+	ReconnectingPTYEnvVar = "TELEPORT_RECONNECT_ID"
+
+	// DefaultReconnectingPTYTimeout is how long a detached PTY is kept
+	// around waiting for a client to re-attach before it is reaped, used
+	// when the Server does not override it via GetReconnectingPTYTimeout.
+	DefaultReconnectingPTYTimeout = 5 * time.Minute
+
+	// reconnectingPTYBufferSize is the size of the scrollback ring buffer
+	// kept per detached session so a reconnecting client can be caught up.
+	reconnectingPTYBufferSize = 64 * 1024
+
+	// reconnectTeeKey identifies this package's scrollback writer among any
+	// others a Terminal implementation fans output out to (e.g. other
+	// parties joined to the same session).
+	reconnectTeeKey = "reconnecting-pty"
+)
+
+// ReconnectingTerminal is implemented by Terminal values that support
+// teeing a copy of their output to additional writers for the life of the
+// session, which the reconnecting PTY registry uses to keep a scrollback
+// buffer current. Terminal implementations that don't support this can
+// still be detached and re-attached, but no scrollback will be replayed on
+// reconnect.
+type ReconnectingTerminal interface {
+	Terminal
+
+	// AddOutputWriter registers w to receive a copy of everything written
+	// to the terminal's output until RemoveOutputWriter(key) is called.
+	AddOutputWriter(key string, w io.Writer)
+
+	// RemoveOutputWriter stops teeing output to the writer registered
+	// under key.
+	RemoveOutputWriter(key string)
+}
+
+// ptyRingBuffer is a fixed-size ring buffer of the most recent bytes written
+// to a PTY. It is used to replay recent scrollback to a client that
+// re-attaches to a detached session. A nil *ptyRingBuffer is valid and
+// behaves as an empty, unwritable buffer.
+type ptyRingBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	next int
+	full bool
+}
+
+func newPTYRingBuffer(size int) *ptyRingBuffer {
+	return &ptyRingBuffer{
+		buf: make([]byte, size),
+	}
+}
+
+// Write implements io.Writer, always succeeding and overwriting the oldest
+// bytes once the buffer is full.
+func (r *ptyRingBuffer) Write(p []byte) (int, error) {
+	if r == nil {
+		return len(p), nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, b := range p {
+		r.buf[r.next] = b
+		r.next = (r.next + 1) % len(r.buf)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+	return len(p), nil
+}
+
+// Bytes returns a snapshot of the buffered data in chronological order.
+func (r *ptyRingBuffer) Bytes() []byte {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		out := make([]byte, r.next)
+		copy(out, r.buf[:r.next])
+		return out
+	}
+
+	out := make([]byte, len(r.buf))
+	copy(out, r.buf[r.next:])
+	copy(out[len(r.buf)-r.next:], r.buf[:r.next])
+	return out
+}
+
+// reconnectingPTYEntry is a detached session kept alive on the server after
+// its owning client connection has gone away, waiting to be re-attached.
+type reconnectingPTYEntry struct {
+	term   Terminal
+	buffer *ptyRingBuffer
+
+	// identity is the Teleport user that originally registered this entry.
+	// reattach refuses to hand the entry back to any other identity, even
+	// one that knows or guesses the reconnect token.
+	identity string
+
+	// timer reaps this entry if no client re-attaches before it fires.
+	timer clockwork.Timer
+
+	// done is closed once this entry is re-attached, so a
+	// continueDisconnectMonitor goroutine started against it knows to stop
+	// instead of reaping whatever (possibly unrelated) entry later gets
+	// registered under the same reconnect token.
+	done chan struct{}
+}
+
+// reconnectingPTYRegistry tracks detached PTYs, keyed by the client-supplied
+// reconnect token, so a subsequent SSH session can re-attach to them.
+type reconnectingPTYRegistry struct {
+	mu      sync.Mutex
+	entries map[string]*reconnectingPTYEntry
+	clock   clockwork.Clock
+}
+
+// defaultReconnectingPTYRegistry is shared by all sessions served out of this
+// process. A single registry (rather than one per ServerContext) is required
+// so that reconnect tokens can be looked up from a brand new SSH connection
+// that has no relationship to the ServerContext that registered them.
+var defaultReconnectingPTYRegistry = newReconnectingPTYRegistry(clockwork.NewRealClock())
+
+func newReconnectingPTYRegistry(clock clockwork.Clock) *reconnectingPTYRegistry {
+	return &reconnectingPTYRegistry{
+		entries: make(map[string]*reconnectingPTYEntry),
+		clock:   clock,
+	}
+}
+
+// register stores term and its scrollback buffer under reconnectID, owned by
+// identity, so they can later be reclaimed by reattach. If a client never
+// reconnects, the entry (and its Terminal) is closed after timeout elapses.
+// The returned entry identifies this specific registration: callers that
+// keep watching the entry after it is superseded (e.g. a disconnect monitor
+// from a previous detach) must reap by entry, not by reconnectID alone, so
+// they can never tear down a later, unrelated registration that reuses the
+// same token.
+func (r *reconnectingPTYRegistry) register(reconnectID, identity string, term Terminal, buffer *ptyRingBuffer, timeout time.Duration) *reconnectingPTYEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := &reconnectingPTYEntry{
+		term:     term,
+		buffer:   buffer,
+		identity: identity,
+		done:     make(chan struct{}),
+	}
+	entry.timer = r.clock.AfterFunc(timeout, func() {
+		r.reap(reconnectID, entry)
+	})
+	r.entries[reconnectID] = entry
+	return entry
+}
+
+// reattach removes and returns the detached terminal and its scrollback
+// buffer previously registered under reconnectID, if one is still pending
+// and was registered by the same identity. A mismatched identity is treated
+// exactly like no entry being found at all, so a token belonging to another
+// user can't be used to probe for its existence or hijack it.
+func (r *reconnectingPTYRegistry) reattach(reconnectID, identity string) (Terminal, *ptyRingBuffer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[reconnectID]
+	if !ok || entry.identity != identity {
+		return nil, nil, false
+	}
+	entry.timer.Stop()
+	close(entry.done)
+	delete(r.entries, reconnectID)
+
+	return entry.term, entry.buffer, true
+}
+
+// reap closes and forgets entry if it is still the one registered under
+// reconnectID, used both when the registration's own timeout fires and when
+// the idle/cert-expiry checks inherited from the original ServerContext fire
+// against a now-detached session. The entry identity check makes this safe
+// to call after the entry has already been superseded by a later
+// registration reusing the same reconnectID, and safe to race against a
+// concurrent reap of the same entry from the other trigger: the map delete
+// happens under r.mu, so only one caller ever observes itself as the one
+// that reaped entry and closes entry.done/entry.term.
+func (r *reconnectingPTYRegistry) reap(reconnectID string, entry *reconnectingPTYEntry) {
+	r.mu.Lock()
+	current, ok := r.entries[reconnectID]
+	reaped := ok && current == entry
+	if reaped {
+		delete(r.entries, reconnectID)
+	}
+	r.mu.Unlock()
+
+	if !reaped {
+		return
+	}
+	close(entry.done)
+	entry.term.Close()
+}
+
+// maybeRegisterReconnectingPTY remembers the client's reconnect token (if
+// any was sent via ReconnectingPTYEnvVar) so that when this context closes,
+// its Terminal can be detached into the reconnecting PTY registry instead of
+// being torn down immediately, and starts teeing its output into a
+// scrollback buffer if the Terminal supports it. sessionID is recorded as
+// the "original session ID" reported on a later PTYReconnect audit event;
+// it is passed in rather than read off c.session because a brand-new
+// session has no *session value yet at this point, only its already-parsed
+// ID.
+func (c *ServerContext) maybeRegisterReconnectingPTY(sessionID rsession.ID) {
+	reconnectID, found := c.GetEnv(ReconnectingPTYEnvVar)
+	if !found || reconnectID == "" {
+		return
+	}
+
+	c.Lock()
+	c.reconnectID = reconnectID
+	c.reconnectSessionID = sessionID
+	c.Unlock()
+
+	c.startReconnectTee()
+}
+
+// startReconnectTee begins teeing this context's terminal output into a
+// scrollback ring buffer, if a reconnect was requested, a Terminal is
+// already attached, and that Terminal implements ReconnectingTerminal. It
+// is idempotent and safe to call repeatedly (e.g. once when the reconnect
+// token becomes known and again once a Terminal is allocated, in whichever
+// order those happen).
+func (c *ServerContext) startReconnectTee() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.reconnectID == "" || c.term == nil || c.reconnectTeeing {
+		return
+	}
+
+	rt, ok := c.term.(ReconnectingTerminal)
+	if !ok {
+		return
+	}
+
+	if c.reconnectBuffer == nil {
+		c.reconnectBuffer = newPTYRingBuffer(reconnectingPTYBufferSize)
+	}
+	rt.AddOutputWriter(reconnectTeeKey, c.reconnectBuffer)
+	c.reconnectTeeing = true
+}
+
+// TakeReconnectingPTY detaches and returns the terminal and scrollback
+// registered for this context's reconnect token, if one was requested, a
+// matching detached session is still pending, and it was registered by the
+// same Teleport identity as this context's. The scrollback buffer is
+// adopted by this context so that output continues accumulating into the
+// same history across further detach/reattach cycles. On success,
+// re-attachment is recorded with a PTYReconnect audit event.
+func (c *ServerContext) TakeReconnectingPTY() (Terminal, *ptyRingBuffer, bool) {
+	c.RLock()
+	reconnectID := c.reconnectID
+	origSessionID := c.reconnectSessionID
+	c.RUnlock()
+
+	if reconnectID == "" {
+		return nil, nil, false
+	}
+
+	term, buffer, ok := defaultReconnectingPTYRegistry.reattach(reconnectID, c.Identity.TeleportUser)
+	if !ok {
+		return nil, nil, false
+	}
+
+	c.Lock()
+	c.reconnectBuffer = buffer
+	c.Unlock()
+
+	c.srv.EmitAuditEvent(events.PTYReconnect, events.EventFields{
+		events.SessionEventID: origSessionID,
+		events.LocalAddr:      c.Conn.LocalAddr().String(),
+		events.RemoteAddr:     c.Conn.RemoteAddr().String(),
+	})
+
+	return term, buffer, true
+}
+
+// maybeReattachReconnectingPTY re-attaches a previously detached PTY if the
+// client's reconnect token matches one still pending in the registry,
+// adopting its Terminal as this context's own (via SetTerm) so the channel
+// wiring that runs stdin/stdout over it resumes talking to the original
+// process instead of allocating a fresh one. Safe to call even when no
+// reconnect was requested or no matching detached session exists.
+func (c *ServerContext) maybeReattachReconnectingPTY() {
+	term, _, ok := c.TakeReconnectingPTY()
+	if !ok {
+		return
+	}
+	c.SetTerm(term)
+}
+
+// ReplayReconnectBuffer writes any scrollback buffered while this context's
+// terminal was detached to w. The caller should invoke this with the new
+// session channel as soon as it is wired up, immediately after a successful
+// reattach, so the client is caught up before further output from the
+// re-adopted process starts arriving.
+func (c *ServerContext) ReplayReconnectBuffer(w io.Writer) error {
+	c.RLock()
+	buffer := c.reconnectBuffer
+	c.RUnlock()
+
+	if buffer == nil {
+		return nil
+	}
+
+	_, err := w.Write(buffer.Bytes())
+	return trace.Wrap(err)
+}
+
+// detachReconnectingPTY hands this context's terminal and its scrollback
+// buffer off to the reconnecting PTY registry instead of closing the
+// terminal, so a future SSH session presenting the same reconnect token can
+// re-attach to both. It returns the registry entry and true if the terminal
+// was detached and should not be closed by the caller.
+func (c *ServerContext) detachReconnectingPTY() (*reconnectingPTYEntry, bool) {
+	c.Lock()
+	reconnectID := c.reconnectID
+	term := c.term
+	buffer := c.reconnectBuffer
+	if reconnectID == "" || term == nil {
+		c.Unlock()
+		return nil, false
+	}
+	c.term = nil
+	// The Terminal being detached here will be a different Go value once
+	// re-attached (a new ServerContext calls SetTerm with it); make sure
+	// that future call re-establishes the tee rather than assuming it's
+	// already wired up.
+	c.reconnectTeeing = false
+	c.Unlock()
+
+	timeout := DefaultReconnectingPTYTimeout
+	if t := c.srv.GetReconnectingPTYTimeout(); t > 0 {
+		timeout = t
+	}
+
+	entry := defaultReconnectingPTYRegistry.register(reconnectID, c.Identity.TeleportUser, term, buffer, timeout)
+	return entry, true
+}
+
+// continueDisconnectMonitor keeps enforcing the idle and cert-expiry
+// deadlines that periodicCheckDisconnect was tracking for c, even after the
+// owning ServerContext has closed and its Terminal was detached into the
+// reconnecting PTY registry. If either deadline is reached before a client
+// re-attaches, the detached session is reaped. If entry is re-attached
+// first, this goroutine stops instead, so it can never reap whatever later,
+// unrelated session ends up registered under the same reconnect token.
+func (c *ServerContext) continueDisconnectMonitor(reconnectID string, entry *reconnectingPTYEntry) {
+	if c.disconnectExpiredCert.IsZero() && c.clientIdleTimeout == 0 {
+		return
+	}
+
+	go func() {
+		var certTime <-chan time.Time
+		if !c.disconnectExpiredCert.IsZero() {
+			t := time.NewTimer(c.disconnectExpiredCert.Sub(c.srv.GetClock().Now().UTC()))
+			defer t.Stop()
+			certTime = t.C
+		}
+
+		var idleTime <-chan time.Time
+		if c.clientIdleTimeout != 0 {
+			t := time.NewTimer(c.clientIdleTimeout)
+			defer t.Stop()
+			idleTime = t.C
+		}
+
+		select {
+		case <-certTime:
+		case <-idleTime:
+		case <-entry.done:
+			return
+		}
+		defaultReconnectingPTYRegistry.reap(reconnectID, entry)
+	}()
+}
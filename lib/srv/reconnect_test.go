@@ -0,0 +1,186 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+)
+
+func TestPTYRingBufferBeforeFull(t *testing.T) {
+	r := newPTYRingBuffer(8)
+	r.Write([]byte("abc"))
+
+	if got := r.Bytes(); !bytes.Equal(got, []byte("abc")) {
+		t.Fatalf("Bytes() = %q, want %q", got, "abc")
+	}
+}
+
+func TestPTYRingBufferWraparound(t *testing.T) {
+	r := newPTYRingBuffer(8)
+
+	// Write more than the buffer's capacity in separate calls, so it wraps
+	// around at least once.
+	r.Write([]byte("abcdef")) // 6 bytes, buffer now "abcdef--"
+	r.Write([]byte("ghij"))   // 4 more bytes, 10 total over an 8 byte buffer
+
+	// Only the most recent 8 bytes should survive, in chronological order.
+	want := "cdefghij"
+	if got := r.Bytes(); string(got) != want {
+		t.Fatalf("Bytes() = %q, want %q", got, want)
+	}
+}
+
+func TestPTYRingBufferExactFit(t *testing.T) {
+	r := newPTYRingBuffer(4)
+	r.Write([]byte("abcd"))
+
+	if got := r.Bytes(); string(got) != "abcd" {
+		t.Fatalf("Bytes() = %q, want %q", got, "abcd")
+	}
+}
+
+func TestPTYRingBufferNilIsSafe(t *testing.T) {
+	var r *ptyRingBuffer
+
+	n, err := r.Write([]byte("abc"))
+	if err != nil || n != 3 {
+		t.Fatalf("Write() on nil buffer = (%d, %v), want (3, nil)", n, err)
+	}
+	if got := r.Bytes(); got != nil {
+		t.Fatalf("Bytes() on nil buffer = %q, want nil", got)
+	}
+}
+
+// fakeRegistryTerminal is the minimal Terminal double the registry's own
+// logic touches: it never reads or writes a PTY, it only reports whether
+// the registry closed it.
+type fakeRegistryTerminal struct {
+	Terminal
+	closed chan struct{}
+}
+
+func newFakeRegistryTerminal() *fakeRegistryTerminal {
+	return &fakeRegistryTerminal{closed: make(chan struct{})}
+}
+
+func (f *fakeRegistryTerminal) Close() error {
+	close(f.closed)
+	return nil
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestRegistryReattachRequiresMatchingIdentity(t *testing.T) {
+	r := newReconnectingPTYRegistry(clockwork.NewFakeClock())
+	term := newFakeRegistryTerminal()
+	entry := r.register("token", "alice", term, nil, time.Minute)
+
+	if _, _, ok := r.reattach("token", "mallory"); ok {
+		t.Fatal("reattach() succeeded with the wrong identity, want failure")
+	}
+	if isClosed(entry.done) {
+		t.Fatal("done was closed by a rejected reattach")
+	}
+
+	got, _, ok := r.reattach("token", "alice")
+	if !ok || got != term {
+		t.Fatalf("reattach(token, alice) = (%v, %v), want (%v, true)", got, ok, term)
+	}
+	if !isClosed(entry.done) {
+		t.Fatal("done was not closed by a successful reattach")
+	}
+}
+
+func TestRegistryReattachUnknownID(t *testing.T) {
+	r := newReconnectingPTYRegistry(clockwork.NewFakeClock())
+
+	if _, _, ok := r.reattach("no-such-token", "alice"); ok {
+		t.Fatal("reattach() succeeded for a token that was never registered")
+	}
+}
+
+func TestRegistryReattachIsOneShot(t *testing.T) {
+	r := newReconnectingPTYRegistry(clockwork.NewFakeClock())
+	term := newFakeRegistryTerminal()
+	r.register("token", "alice", term, nil, time.Minute)
+
+	if _, _, ok := r.reattach("token", "alice"); !ok {
+		t.Fatal("first reattach() failed, want success")
+	}
+	if _, _, ok := r.reattach("token", "alice"); ok {
+		t.Fatal("second reattach() succeeded, want the entry to already be gone")
+	}
+}
+
+func TestRegistryReapsOnTimeout(t *testing.T) {
+	clock := clockwork.NewFakeClock()
+	r := newReconnectingPTYRegistry(clock)
+	term := newFakeRegistryTerminal()
+	entry := r.register("token", "alice", term, nil, time.Minute)
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+
+	select {
+	case <-term.closed:
+	case <-time.After(time.Second):
+		t.Fatal("timeout fired but the terminal was never closed")
+	}
+	if !isClosed(entry.done) {
+		t.Fatal("done was not closed when the entry was reaped on timeout")
+	}
+	if _, _, ok := r.reattach("token", "alice"); ok {
+		t.Fatal("reattach() succeeded for an entry that should have been reaped")
+	}
+}
+
+func TestRegistryReapIgnoresSupersededEntry(t *testing.T) {
+	r := newReconnectingPTYRegistry(clockwork.NewFakeClock())
+	staleTerm := newFakeRegistryTerminal()
+	staleEntry := r.register("token", "alice", staleTerm, nil, time.Minute)
+
+	// Simulate the token being reused for a brand new registration after the
+	// first one was already reattached and superseded.
+	if _, _, ok := r.reattach("token", "alice"); !ok {
+		t.Fatal("reattach() of the original entry failed, want success")
+	}
+	currentTerm := newFakeRegistryTerminal()
+	r.register("token", "alice", currentTerm, nil, time.Minute)
+
+	// A reap racing in for the stale entry (e.g. from a disconnect monitor
+	// that hadn't yet noticed staleEntry.done closing) must not touch the
+	// new registration under the same token.
+	r.reap("token", staleEntry)
+
+	if isClosed(currentTerm.closed) {
+		t.Fatal("reap() of a superseded entry closed the current registration's terminal")
+	}
+	if _, _, ok := r.reattach("token", "alice"); !ok {
+		t.Fatal("the current registration was reaped by a stale reap() call")
+	}
+}
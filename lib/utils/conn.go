@@ -23,6 +23,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gravitational/trace"
@@ -91,8 +92,10 @@ func RoundtripWithConn(conn net.Conn) (string, error) {
 }
 
 // StatConn is a net.Conn that keeps track of how much data was transmitted
-// (TX) and received (RX) over the net.Conn. A maximum of about 18446
-// petabytes can be kept track of for TX and RX before it rolls over.
+// (TX) and received (RX) over the net.Conn. Counters are updated with the
+// actual number of bytes moved by the wrapped Read/Write, not the size of
+// the caller's buffer, and are safe for concurrent use. A maximum of about
+// 18446 petabytes can be kept track of for TX and RX before it rolls over.
 // See https://golang.org/ref/spec#Numeric_types for more details.
 type StatConn struct {
 	conn net.Conn
@@ -107,19 +110,32 @@ func NewStatConn(conn net.Conn) *StatConn {
 	}
 }
 
-// Stat returns the transmitted (TX) and received (RX) bytes over the net.Conn.
+// Stat returns a snapshot of the transmitted (TX) and received (RX) bytes
+// over the net.Conn.
 func (s *StatConn) Stat() (uint64, uint64) {
-	return s.txBytes, s.rxBytes
+	return s.WriteBytes(), s.ReadBytes()
+}
+
+// ReadBytes returns the number of bytes read from the net.Conn so far.
+func (s *StatConn) ReadBytes() uint64 {
+	return atomic.LoadUint64(&s.rxBytes)
+}
+
+// WriteBytes returns the number of bytes written to the net.Conn so far.
+func (s *StatConn) WriteBytes() uint64 {
+	return atomic.LoadUint64(&s.txBytes)
 }
 
 func (s *StatConn) Read(b []byte) (n int, err error) {
-	s.rxBytes = s.rxBytes + uint64(len(b))
-	return s.conn.Read(b)
+	n, err = s.conn.Read(b)
+	atomic.AddUint64(&s.rxBytes, uint64(n))
+	return n, err
 }
 
 func (s *StatConn) Write(b []byte) (n int, err error) {
-	s.txBytes = s.txBytes + uint64(len(b))
-	return s.conn.Write(b)
+	n, err = s.conn.Write(b)
+	atomic.AddUint64(&s.txBytes, uint64(n))
+	return n, err
 }
 
 func (s *StatConn) Close() error {
@@ -0,0 +1,114 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+// shortConn is a net.Conn whose Read and Write only ever move at most
+// maxPerCall bytes, regardless of how large the caller's buffer is, so tests
+// can tell whether a wrapper counts len(b) or the bytes actually moved.
+type shortConn struct {
+	net.Conn
+	maxPerCall int
+}
+
+func (c *shortConn) Read(b []byte) (int, error) {
+	if len(b) > c.maxPerCall {
+		b = b[:c.maxPerCall]
+	}
+	for i := range b {
+		b[i] = 'x'
+	}
+	return len(b), nil
+}
+
+func (c *shortConn) Write(b []byte) (int, error) {
+	if len(b) > c.maxPerCall {
+		b = b[:c.maxPerCall]
+	}
+	return len(b), nil
+}
+
+func TestStatConnCountsActualBytes(t *testing.T) {
+	inner := &shortConn{maxPerCall: 3}
+	s := NewStatConn(inner)
+
+	n, err := s.Read(make([]byte, 10))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("Read() = %d, want 3", n)
+	}
+	if got := s.ReadBytes(); got != 3 {
+		t.Fatalf("ReadBytes() = %d, want 3 (actual bytes moved, not len(b))", got)
+	}
+
+	n, err = s.Write(make([]byte, 10))
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("Write() = %d, want 3", n)
+	}
+	if got := s.WriteBytes(); got != 3 {
+		t.Fatalf("WriteBytes() = %d, want 3 (actual bytes moved, not len(b))", got)
+	}
+
+	tx, rx := s.Stat()
+	if tx != 3 || rx != 3 {
+		t.Fatalf("Stat() = (%d, %d), want (3, 3)", tx, rx)
+	}
+}
+
+func TestStatConnConcurrentAccess(t *testing.T) {
+	inner := &shortConn{maxPerCall: 4}
+	s := NewStatConn(inner)
+
+	const goroutines = 20
+	const iterations = 50
+
+	var wg sync.WaitGroup
+	wg.Add(goroutines * 2)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				s.Read(make([]byte, 4))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				s.Write(make([]byte, 4))
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := uint64(goroutines * iterations * 4)
+	if got := s.ReadBytes(); got != want {
+		t.Fatalf("ReadBytes() = %d, want %d", got, want)
+	}
+	if got := s.WriteBytes(); got != want {
+		t.Fatalf("WriteBytes() = %d, want %d", got, want)
+	}
+}
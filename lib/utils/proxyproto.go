@@ -0,0 +1,272 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// ProxyProtocolMode controls whether a listener accepts a HAProxy PROXY
+// protocol (v1 or v2) header ahead of the TLS/SSH handshake on incoming
+// connections.
+type ProxyProtocolMode string
+
+const (
+	// ProxyProtocolOff never looks for a PROXY protocol header; connections
+	// are used as-is. This is the default.
+	ProxyProtocolOff ProxyProtocolMode = "off"
+
+	// ProxyProtocolOptional accepts a PROXY protocol header if present, but
+	// also accepts connections that go straight into the handshake.
+	ProxyProtocolOptional ProxyProtocolMode = "optional"
+
+	// ProxyProtocolRequired rejects any connection that does not begin with
+	// a valid PROXY protocol header.
+	ProxyProtocolRequired ProxyProtocolMode = "required"
+)
+
+// ExtProxyAddr is the SSH certificate/permission extension key used to carry
+// the load balancer's address (as recovered from a PROXY protocol header)
+// from the listener into the SSH connection's Permissions, so it can be
+// picked up when building a ServerContext.
+const ExtProxyAddr = "proxy-addr@teleport"
+
+// proxyProtoV1Prefix is the marker that starts every PROXY protocol v1
+// header line.
+const proxyProtoV1Prefix = "PROXY "
+
+// proxyProtoV1MaxHeaderLen is the maximum length of a PROXY protocol v1
+// header line, per spec (including the trailing "\r\n").
+const proxyProtoV1MaxHeaderLen = 107
+
+// proxyProtoV2Signature is the 12 byte magic that starts every PROXY
+// protocol v2 header, as defined by the spec.
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// ProxyProtoConn wraps a net.Conn that was preceded by a HAProxy PROXY
+// protocol header. RemoteAddr returns the original client address recovered
+// from the header, while ProxyAddr returns the address of the load balancer
+// or proxy that actually opened the TCP connection (i.e. what the wrapped
+// conn's own RemoteAddr() would have returned).
+type ProxyProtoConn struct {
+	net.Conn
+
+	clientAddr net.Addr
+	proxyAddr  net.Addr
+}
+
+// RemoteAddr returns the real client address recovered from the PROXY
+// protocol header.
+func (c *ProxyProtoConn) RemoteAddr() net.Addr {
+	return c.clientAddr
+}
+
+// ProxyAddr returns the address of the load balancer/proxy that terminated
+// the TCP connection carrying the PROXY protocol header.
+func (c *ProxyProtoConn) ProxyAddr() net.Addr {
+	return c.proxyAddr
+}
+
+// NewProxyProtocolConn inspects conn for a leading PROXY protocol v1 or v2
+// header according to mode. With ProxyProtocolOff, conn is returned
+// unmodified. With ProxyProtocolOptional and ProxyProtocolRequired, a header
+// is parsed if present; ProxyProtocolRequired additionally returns an error
+// if conn does not begin with one. A well-formed header reporting "UNKNOWN"
+// (v1) or the LOCAL command (v2) is not an error — it means the proxy
+// itself has no remapped address to report (e.g. a load balancer health
+// check), so the connection's own addresses are used, same as if no header
+// had been sent at all.
+func NewProxyProtocolConn(conn net.Conn, mode ProxyProtocolMode) (net.Conn, error) {
+	if mode == ProxyProtocolOff {
+		return conn, nil
+	}
+
+	r := bufio.NewReader(conn)
+
+	sig, err := r.Peek(len(proxyProtoV2Signature))
+	switch {
+	case err == nil && string(sig) == string(proxyProtoV2Signature):
+		clientAddr, err := parseProxyProtoV2(r)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return newProxyProtoConn(conn, r, clientAddr), nil
+	default:
+		prefix, err := r.Peek(len(proxyProtoV1Prefix))
+		if err == nil && string(prefix) == proxyProtoV1Prefix {
+			clientAddr, err := parseProxyProtoV1(r)
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			return newProxyProtoConn(conn, r, clientAddr), nil
+		}
+	}
+
+	if mode == ProxyProtocolRequired {
+		return nil, trace.BadParameter("connection from %v did not start with a PROXY protocol header", conn.RemoteAddr())
+	}
+
+	// No header found and it wasn't required: hand back a conn that still
+	// reads through the bufio.Reader so the bytes already peeked above are
+	// not lost.
+	return &bufioConn{Conn: conn, r: r}, nil
+}
+
+// newProxyProtoConn wraps conn (via r, so already-buffered bytes aren't
+// lost) as a ProxyProtoConn. clientAddr may be nil (UNKNOWN/LOCAL), in which
+// case RemoteAddr falls back to the underlying connection's own address,
+// same as if no header had been parsed at all.
+func newProxyProtoConn(conn net.Conn, r *bufio.Reader, clientAddr net.Addr) net.Conn {
+	wrapped := &bufioConn{Conn: conn, r: r}
+	if clientAddr == nil {
+		return wrapped
+	}
+	return &ProxyProtoConn{
+		Conn:       wrapped,
+		clientAddr: clientAddr,
+		proxyAddr:  conn.RemoteAddr(),
+	}
+}
+
+// bufioConn is a net.Conn whose Read is satisfied from a bufio.Reader
+// wrapping the same underlying connection, so bytes peeked while probing for
+// a PROXY protocol header are not discarded.
+type bufioConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufioConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// parseProxyProtoV1 consumes and parses a PROXY protocol v1 text header
+// ("PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n") from r, returning the
+// source (client) address it describes, or a nil address (with a nil error)
+// if the header reports "UNKNOWN".
+func parseProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := readLimitedLine(r, proxyProtoV1MaxHeaderLen)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return nil, trace.BadParameter("malformed PROXY protocol v1 header: %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, trace.BadParameter("malformed PROXY protocol v1 header: %q", line)
+	}
+
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	return &net.TCPAddr{IP: net.ParseIP(fields[2]), Port: port}, nil
+}
+
+// readLimitedLine reads from r up to and including the next '\n', refusing
+// to buffer more than maxLen bytes. This bounds how much an unauthenticated,
+// pre-handshake connection can make the server hold in memory while a PROXY
+// protocol v1 header is awaited.
+func readLimitedLine(r *bufio.Reader, maxLen int) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", trace.Wrap(err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			return string(line), nil
+		}
+		if len(line) >= maxLen {
+			return "", trace.BadParameter("PROXY protocol v1 header exceeds %v bytes", maxLen)
+		}
+	}
+}
+
+// parseProxyProtoV2 consumes and parses a PROXY protocol v2 binary header
+// from r, returning the source (client) address it describes, or a nil
+// address (with a nil error) for the LOCAL command, which carries none.
+func parseProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	if _, err := r.Discard(len(proxyProtoV2Signature)); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	verCmd, err := r.ReadByte()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if verCmd>>4 != 2 {
+		return nil, trace.BadParameter("unsupported PROXY protocol version: %x", verCmd>>4)
+	}
+	cmd := verCmd & 0x0F
+
+	famProto, err := r.ReadByte()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	family := famProto >> 4
+
+	addrLenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, addrLenBuf); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	addrLen := binary.BigEndian.Uint16(addrLenBuf)
+
+	body := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// A LOCAL command carries no meaningful address: the proxy is
+	// originating the connection itself (e.g. a health check), so the
+	// connection's own addresses should be used, same as no header at all.
+	if cmd == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, trace.BadParameter("short PROXY protocol v2 IPv4 address block")
+		}
+		srcPort := binary.BigEndian.Uint16(body[8:10])
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(srcPort)}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, trace.BadParameter("short PROXY protocol v2 IPv6 address block")
+		}
+		srcPort := binary.BigEndian.Uint16(body[32:34])
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(srcPort)}, nil
+	default:
+		return nil, trace.BadParameter("unsupported PROXY protocol v2 address family: %x", family)
+	}
+}
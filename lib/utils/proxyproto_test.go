@@ -0,0 +1,196 @@
+/*
+Copyright 2017 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeConn is a minimal net.Conn backed by an in-memory reader, enough to
+// exercise NewProxyProtocolConn without a real socket.
+type fakeConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *fakeConn) RemoteAddr() net.Addr       { return &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345} }
+func (c *fakeConn) LocalAddr() net.Addr        { return &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 3022} }
+
+func TestProxyProtoV1ClientAddr(t *testing.T) {
+	raw := "PROXY TCP4 203.0.113.5 10.0.0.2 56324 3022\r\npayload"
+	conn, err := NewProxyProtocolConn(&fakeConn{r: strings.NewReader(raw)}, ProxyProtocolRequired)
+	if err != nil {
+		t.Fatalf("NewProxyProtocolConn: %v", err)
+	}
+
+	pp, ok := conn.(*ProxyProtoConn)
+	if !ok {
+		t.Fatalf("expected *ProxyProtoConn, got %T", conn)
+	}
+	if got := pp.RemoteAddr().String(); got != "203.0.113.5:56324" {
+		t.Fatalf("RemoteAddr() = %v, want 203.0.113.5:56324", got)
+	}
+	if got := pp.ProxyAddr().String(); got != "10.0.0.1:12345" {
+		t.Fatalf("ProxyAddr() = %v, want 10.0.0.1:12345", got)
+	}
+
+	rest, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(rest) != "payload" {
+		t.Fatalf("payload after header = %q, want %q", rest, "payload")
+	}
+}
+
+func TestProxyProtoV1Unknown(t *testing.T) {
+	raw := "PROXY UNKNOWN\r\npayload"
+	conn, err := NewProxyProtocolConn(&fakeConn{r: strings.NewReader(raw)}, ProxyProtocolRequired)
+	if err != nil {
+		t.Fatalf("NewProxyProtocolConn: %v", err)
+	}
+
+	// UNKNOWN is not an error: the connection's own addresses should be
+	// used, so it must not be wrapped in *ProxyProtoConn.
+	if _, ok := conn.(*ProxyProtoConn); ok {
+		t.Fatalf("UNKNOWN header should not produce a *ProxyProtoConn")
+	}
+
+	rest, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(rest) != "payload" {
+		t.Fatalf("payload after header = %q, want %q", rest, "payload")
+	}
+}
+
+func TestProxyProtoV1HeaderTooLong(t *testing.T) {
+	raw := "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"
+	_, err := NewProxyProtocolConn(&fakeConn{r: strings.NewReader(raw)}, ProxyProtocolRequired)
+	if err == nil {
+		t.Fatal("expected an error for an oversized PROXY v1 header, got nil")
+	}
+}
+
+func TestProxyProtoV2ClientAddr(t *testing.T) {
+	var buf []byte
+	buf = append(buf, proxyProtoV2Signature...)
+	buf = append(buf, 0x21) // version 2, command PROXY
+	buf = append(buf, 0x11) // AF_INET, STREAM
+
+	var addr [12]byte
+	copy(addr[0:4], net.ParseIP("203.0.113.5").To4())
+	copy(addr[4:8], net.ParseIP("10.0.0.2").To4())
+	binary.BigEndian.PutUint16(addr[8:10], 56324)
+	binary.BigEndian.PutUint16(addr[10:12], 3022)
+
+	lenBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(addr)))
+	buf = append(buf, lenBuf...)
+	buf = append(buf, addr[:]...)
+	buf = append(buf, []byte("payload")...)
+
+	conn, err := NewProxyProtocolConn(&fakeConn{r: strings.NewReader(string(buf))}, ProxyProtocolRequired)
+	if err != nil {
+		t.Fatalf("NewProxyProtocolConn: %v", err)
+	}
+
+	pp, ok := conn.(*ProxyProtoConn)
+	if !ok {
+		t.Fatalf("expected *ProxyProtoConn, got %T", conn)
+	}
+	if got := pp.RemoteAddr().String(); got != "203.0.113.5:56324" {
+		t.Fatalf("RemoteAddr() = %v, want 203.0.113.5:56324", got)
+	}
+
+	rest, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(rest) != "payload" {
+		t.Fatalf("payload after header = %q, want %q", rest, "payload")
+	}
+}
+
+func TestProxyProtoV2Local(t *testing.T) {
+	var buf []byte
+	buf = append(buf, proxyProtoV2Signature...)
+	buf = append(buf, 0x20) // version 2, command LOCAL
+	buf = append(buf, 0x00) // AF_UNSPEC, UNSPEC
+	buf = append(buf, 0x00, 0x00)
+	buf = append(buf, []byte("payload")...)
+
+	conn, err := NewProxyProtocolConn(&fakeConn{r: strings.NewReader(string(buf))}, ProxyProtocolRequired)
+	if err != nil {
+		t.Fatalf("NewProxyProtocolConn: %v", err)
+	}
+
+	// LOCAL is not an error: the connection's own addresses should be
+	// used, so it must not be wrapped in *ProxyProtoConn.
+	if _, ok := conn.(*ProxyProtoConn); ok {
+		t.Fatalf("LOCAL command should not produce a *ProxyProtoConn")
+	}
+
+	rest, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(rest) != "payload" {
+		t.Fatalf("payload after header = %q, want %q", rest, "payload")
+	}
+}
+
+func TestProxyProtoRequiredRejectsPlainConn(t *testing.T) {
+	_, err := NewProxyProtocolConn(&fakeConn{r: strings.NewReader("not a proxy header")}, ProxyProtocolRequired)
+	if err == nil {
+		t.Fatal("expected an error in required mode without a PROXY header, got nil")
+	}
+}
+
+func TestProxyProtoOptionalPassesThroughUnreadBytes(t *testing.T) {
+	conn, err := NewProxyProtocolConn(&fakeConn{r: strings.NewReader("hello world")}, ProxyProtocolOptional)
+	if err != nil {
+		t.Fatalf("NewProxyProtocolConn: %v", err)
+	}
+
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(out) != "hello world" {
+		t.Fatalf("ReadAll() = %q, want %q (bytes peeked while probing must not be lost)", out, "hello world")
+	}
+}
+
+func TestProxyProtoOff(t *testing.T) {
+	raw := "PROXY TCP4 203.0.113.5 10.0.0.2 56324 3022\r\n"
+	c := &fakeConn{r: strings.NewReader(raw)}
+	conn, err := NewProxyProtocolConn(c, ProxyProtocolOff)
+	if err != nil {
+		t.Fatalf("NewProxyProtocolConn: %v", err)
+	}
+	if conn != net.Conn(c) {
+		t.Fatalf("ProxyProtocolOff should return the conn unmodified")
+	}
+}